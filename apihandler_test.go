@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+func TestAPISeverity(t *testing.T) {
+	cases := []struct {
+		level slog.Level
+		want  logging.Severity
+	}{
+		{slog.LevelDebug, logging.Debug},
+		{slog.LevelInfo, logging.Info},
+		{LevelNotice, logging.Notice},
+		{slog.LevelWarn, logging.Warning},
+		{slog.LevelError, logging.Error},
+		{LevelCritical, logging.Critical},
+		{LevelAlert, logging.Alert},
+		{LevelEmergency, logging.Emergency},
+	}
+
+	for _, tc := range cases {
+		if got := apiSeverity(tc.level); got != tc.want {
+			t.Errorf("apiSeverity(%v) = %v, want %v", tc.level, got, tc.want)
+		}
+	}
+}
+
+func TestAPIPayloadReplaysGroupsAndAttrs(t *testing.T) {
+	var h slog.Handler = &CloudLoggingHandler{}
+	h = h.WithAttrs([]slog.Attr{slog.String("component", "api")})
+	h = h.WithGroup("request")
+	h = h.WithAttrs([]slog.Attr{slog.Int("attempt", 2)})
+
+	rec := slog.NewRecord(time.Time{}, slog.LevelInfo, "did a thing", 0)
+	rec.AddAttrs(slog.String("outcome", "ok"), slog.Any("httpRequest", httpRequestInfo{Status: 200}))
+
+	payload := h.(*CloudLoggingHandler).apiPayload(rec)
+
+	want := map[string]any{
+		"message":   "did a thing",
+		"component": "api",
+		"request": map[string]any{
+			"attempt": int64(2),
+			"outcome": "ok",
+		},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("apiPayload = %#v, want %#v", payload, want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestFormatLatency(t *testing.T) {
+	cases := []struct {
+		name string
+		d    time.Duration
+		want string
+	}{
+		{"whole seconds", 2 * time.Second, "2s"},
+		{"trailing zeros trimmed", 123 * time.Millisecond, "0.123s"},
+		{"nanosecond precision", 123456789 * time.Nanosecond, "0.123456789s"},
+		{"zero", 0, "0s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatLatency(tc.d); got != tc.want {
+				t.Errorf("formatLatency(%v) = %q, want %q", tc.d, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLevelForStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		want   slog.Level
+	}{
+		{200, slog.LevelInfo},
+		{301, slog.LevelInfo},
+		{404, slog.LevelWarn},
+		{499, slog.LevelWarn},
+		{500, slog.LevelError},
+		{503, slog.LevelError},
+	}
+
+	for _, tc := range cases {
+		if got := levelForStatus(tc.status); got != tc.want {
+			t.Errorf("levelForStatus(%d) = %v, want %v", tc.status, got, tc.want)
+		}
+	}
+}
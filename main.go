@@ -1,25 +1,129 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/logging"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
 )
 
-// Extra log level supported by Cloud Logging
+// Extra log levels supported by Cloud Logging, in between and above the
+// levels slog defines out of the box.
+// See https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogSeverity
 const (
-	LevelCritical = slog.Level(12)
+	LevelNotice    = slog.Level(2)
+	LevelCritical  = slog.Level(12)
+	LevelAlert     = slog.Level(16)
+	LevelEmergency = slog.Level(20)
 )
 
+// severityString translates a slog.Level, including the Cloud Logging
+// specific levels above, to the corresponding Cloud Logging severity string.
+func severityString(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < LevelNotice:
+		return "INFO"
+	case level < slog.LevelWarn:
+		return "NOTICE"
+	case level < slog.LevelError:
+		return "WARNING"
+	case level < LevelCritical:
+		return "ERROR"
+	case level < LevelAlert:
+		return "CRITICAL"
+	case level < LevelEmergency:
+		return "ALERT"
+	default:
+		return "EMERGENCY"
+	}
+}
+
+// Notice logs at LevelNotice.
+func Notice(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, LevelNotice, msg, args...)
+}
+
+// Critical logs at LevelCritical.
+func Critical(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, LevelCritical, msg, args...)
+}
+
+// Alert logs at LevelAlert.
+func Alert(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, LevelAlert, msg, args...)
+}
+
+// Emergency logs at LevelEmergency.
+func Emergency(ctx context.Context, msg string, args ...any) {
+	slog.Default().Log(ctx, LevelEmergency, msg, args...)
+}
+
+// traceContextKey is the context key under which the request's trace info is stored.
+// It is an unexported struct type so it can never collide with keys set by other packages.
+type traceContextKey struct{}
+
+// traceInfo holds the trace/span information extracted from the incoming request headers.
+type traceInfo struct {
+	trace   string // full resource name: projects/<project>/traces/<trace-id>
+	spanID  string
+	sampled bool
+}
+
+// traceparentRe matches the W3C Trace Context header format
+// "<2 hex version>-<32 hex trace-id>-<16 hex span-id>-<2 hex flags>".
+// See https://www.w3.org/TR/trace-context/#traceparent-header
+var traceparentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// allZero reports whether s consists entirely of the character '0'.
+func allZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// parseTraceParent extracts the trace id, span id and sampled flag from a
+// traceparent header value. Per the W3C spec, version "ff" is reserved and
+// an all-zero trace-id or span-id is invalid, so both are rejected.
+func parseTraceParent(header string) (traceID, spanID string, sampled bool, ok bool) {
+	m := traceparentRe.FindStringSubmatch(header)
+	if m == nil {
+		return "", "", false, false
+	}
+	version, traceID, spanID := m[1], m[2], m[3]
+	if version == "ff" || allZero(traceID) || allZero(spanID) {
+		return "", "", false, false
+	}
+	flags, err := strconv.ParseUint(m[4], 16, 8)
+	if err != nil {
+		return "", "", false, false
+	}
+	return traceID, spanID, flags&1 == 1, true
+}
+
 // Middleware that adds the Cloud Trace ID to the context
 // This is used to correlate the structured logs with the Cloud Run
 // request log.
+//
+// Both the W3C "traceparent" header (as set by OpenTelemetry-instrumented
+// upstream services) and Cloud Run's own "X-Cloud-Trace-Context" header are
+// understood; "traceparent" is preferred when both are present.
 func WithCloudTraceContext(h http.Handler) http.Handler {
 	// Get the project ID from the environment if specified
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
@@ -36,72 +140,732 @@ func WithCloudTraceContext(h http.Handler) http.Handler {
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var trace string
-		traceHeader := r.Header.Get("X-Cloud-Trace-Context")
-		traceParts := strings.Split(traceHeader, "/")
-		if len(traceParts) > 0 && len(traceParts[0]) > 0 {
-			trace = fmt.Sprintf("projects/%s/traces/%s", projectID, traceParts[0])
+		var info traceInfo
+		if traceID, spanID, sampled, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+			info = traceInfo{
+				trace:   fmt.Sprintf("projects/%s/traces/%s", projectID, traceID),
+				spanID:  spanID,
+				sampled: sampled,
+			}
+		} else {
+			traceHeader := r.Header.Get("X-Cloud-Trace-Context")
+			traceParts := strings.Split(traceHeader, "/")
+			if len(traceParts) > 0 && len(traceParts[0]) > 0 {
+				info.trace = fmt.Sprintf("projects/%s/traces/%s", projectID, traceParts[0])
+			}
 		}
-		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "trace", trace)))
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, info)))
+	})
+}
+
+func traceInfoFromContext(ctx context.Context) traceInfo {
+	info, _ := ctx.Value(traceContextKey{}).(traceInfo)
+	return info
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// labelsContextKey is the context key under which request-scoped labels are stored.
+type labelsContextKey struct{}
+
+// WithLabels returns a derived context that adds the given key/value label
+// pairs to every log entry made with it, merged with any labels already
+// present on ctx (the new values win on key collisions). This lets a caller
+// tag every log within a request scope, e.g. WithLabels(ctx, "user_id", id),
+// without threading attributes through every call.
+func WithLabels(ctx context.Context, kvs ...string) context.Context {
+	labels := maps.Clone(labelsFromContext(ctx))
+	if labels == nil {
+		labels = make(map[string]string, len(kvs)/2)
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		labels[kvs[i]] = kvs[i+1]
+	}
+	return context.WithValue(ctx, labelsContextKey{}, labels)
+}
+
+func labelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsContextKey{}).(map[string]string)
+	return labels
+}
+
+// operationContextKey is the context key under which the current long-running operation is stored.
+type operationContextKey struct{}
+
+// operationInfo identifies the long-running operation a log entry belongs to.
+type operationInfo struct {
+	id       string
+	producer string
+	first    bool
+	last     bool
+}
+
+// WithOperation returns a derived context that tags every log entry made
+// with it as part of the named long-running operation, letting Cloud
+// Logging group the entries together in the UI. first and last mark the
+// entry that starts, respectively ends, the operation.
+func WithOperation(ctx context.Context, id, producer string, first, last bool) context.Context {
+	return context.WithValue(ctx, operationContextKey{}, operationInfo{
+		id:       id,
+		producer: producer,
+		first:    first,
+		last:     last,
 	})
 }
 
-func traceFromContext(ctx context.Context) string {
-	trace := ctx.Value("trace")
-	if trace == nil {
+func operationFromContext(ctx context.Context) (operationInfo, bool) {
+	op, ok := ctx.Value(operationContextKey{}).(operationInfo)
+	return op, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// levelForStatus derives a log severity from an HTTP response status code:
+// 2xx/3xx -> INFO, 4xx -> WARNING, 5xx -> ERROR.
+func levelForStatus(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// remoteIP returns the requesting client's IP address, stripped of its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// serverIP returns the local address the request was accepted on, stripped of its port.
+func serverIP(ctx context.Context) string {
+	addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
 		return ""
 	}
-	return trace.(string)
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// httpRequestInfo carries the data captured by LogHTTPRequest as a single
+// attribute value. The exported fields are what gets marshaled into the
+// stderr JSON "httpRequest" special field; the unexported ones carry the
+// raw values NewCloudLoggingAPIHandler needs to populate a
+// logging.HTTPRequest instead.
+type httpRequestInfo struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestUrl    string `json:"requestUrl"`
+	RequestSize   string `json:"requestSize"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"`
+	UserAgent     string `json:"userAgent"`
+	RemoteIp      string `json:"remoteIp"`
+	ServerIp      string `json:"serverIp"`
+	Referer       string `json:"referer"`
+	Latency       string `json:"latency"`
+	Protocol      string `json:"protocol"`
+
+	request      *http.Request
+	responseSize int64
+	latency      time.Duration
+}
+
+// formatLatency renders a duration as the seconds string Cloud Logging's
+// httpRequest.latency expects, e.g. "0.123s" rather than "0.123000000s".
+func formatLatency(d time.Duration) string {
+	s := strconv.FormatFloat(d.Seconds(), 'f', 9, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	return s + "s"
+}
+
+// LogHTTPRequest emits a single structured log entry describing one HTTP
+// request/response cycle, populating Cloud Logging's special "httpRequest"
+// field. Severity is derived from status.
+// See https://cloud.google.com/logging/docs/agent/logging/configuration#special-fields
+func LogHTTPRequest(ctx context.Context, r *http.Request, status, responseSize int, latency time.Duration) {
+	slog.Log(ctx, levelForStatus(status), fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, status),
+		slog.Any("httpRequest", httpRequestInfo{
+			RequestMethod: r.Method,
+			RequestUrl:    r.URL.String(),
+			RequestSize:   strconv.FormatInt(r.ContentLength, 10),
+			Status:        status,
+			ResponseSize:  strconv.Itoa(responseSize),
+			UserAgent:     r.UserAgent(),
+			RemoteIp:      remoteIP(r),
+			ServerIp:      serverIP(ctx),
+			Referer:       r.Referer(),
+			Latency:       formatLatency(latency),
+			Protocol:      r.Proto,
+
+			request:      r,
+			responseSize: int64(responseSize),
+			latency:      latency,
+		}),
+	)
+}
+
+// statusResponseWriter wraps an http.ResponseWriter to capture the status
+// code and number of bytes written, for use by WithHTTPLogging.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher by delegating to the wrapped
+// ResponseWriter, if it supports it, so streamed (e.g. SSE) responses keep
+// working behind WithHTTPLogging.
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker by delegating to the wrapped
+// ResponseWriter, if it supports it, so connection upgrades (e.g.
+// WebSockets) keep working behind WithHTTPLogging.
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("cloudrun-slog: underlying ResponseWriter does not support Hijack")
+	}
+	return hj.Hijack()
+}
+
+// ReadFrom implements io.ReaderFrom by delegating to the wrapped
+// ResponseWriter, if it supports it, while still tracking bytes written.
+func (w *statusResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		w.size += int(n)
+		return n, err
+	}
+	// writerOnly hides statusResponseWriter's own ReadFrom from io.Copy, which
+	// would otherwise prefer it and recurse back into this method forever.
+	return io.Copy(writerOnly{w}, r)
+}
+
+type writerOnly struct{ io.Writer }
+
+// Middleware that logs a single structured entry per request via
+// LogHTTPRequest, once the handler has written its response.
+func WithHTTPLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		LogHTTPRequest(r.Context(), r, sw.status, sw.size, time.Since(start))
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// Option configures a CloudLoggingHandler.
+type Option func(*handlerConfig)
+
+type handlerConfig struct {
+	errorReporting *errorReportingConfig
+	batchSize      int
+	flushInterval  time.Duration
+}
+
+type errorReportingConfig struct {
+	service string
+	version string
+}
+
+// WithErrorReporting makes the handler attach a stack trace and the @type
+// marker Error Reporting looks for to every record at ERROR severity or
+// above, so Google Cloud Error Reporting picks it up automatically.
+// See https://cloud.google.com/error-reporting/docs/formatting-error-messages
+func WithErrorReporting(serviceName, version string) Option {
+	return func(c *handlerConfig) {
+		c.errorReporting = &errorReportingConfig{service: serviceName, version: version}
+	}
+}
+
+// BatchSize sets how many entries NewCloudLoggingAPIHandler buffers before
+// flushing a batch to the Cloud Logging API. Only used by
+// NewCloudLoggingAPIHandler; ignored by NewCloudLoggingHandler.
+func BatchSize(n int) Option {
+	return func(c *handlerConfig) { c.batchSize = n }
+}
+
+// FlushInterval sets the maximum time NewCloudLoggingAPIHandler buffers
+// entries before flushing a batch to the Cloud Logging API. Only used by
+// NewCloudLoggingAPIHandler; ignored by NewCloudLoggingHandler.
+func FlushInterval(d time.Duration) Option {
+	return func(c *handlerConfig) { c.flushInterval = d }
+}
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+)
+
 // Handler that outputs JSON understood by the structured log agent.
 // See https://cloud.google.com/logging/docs/agent/logging/configuration#special-fields
-type CloudLoggingHandler struct{ handler slog.Handler }
-
-func NewCloudLoggingHandler() *CloudLoggingHandler {
-	return &CloudLoggingHandler{handler: slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     slog.LevelDebug,
-		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-			if a.Key == slog.MessageKey {
-				a.Key = "message"
-			} else if a.Key == slog.SourceKey {
-				a.Key = "logging.googleapis.com/sourceLocation"
-			} else if a.Key == slog.LevelKey {
-				a.Key = "severity"
-				level := a.Value.Any().(slog.Level)
-				if level == LevelCritical {
-					a.Value = slog.StringValue("CRITICAL")
+//
+// Alternatively, a CloudLoggingHandler returned by NewCloudLoggingAPIHandler
+// writes entries via the Cloud Logging API instead.
+type CloudLoggingHandler struct {
+	handler        slog.Handler
+	writer         *topLevelWriter // only set alongside handler; nil for the API path
+	errorReporting *errorReportingConfig
+	apiLogger      *logging.Logger
+	// goas records the WithAttrs/WithGroup calls made on this handler, in
+	// order. The JSON path lets the underlying slog.Handler track these;
+	// the API path has no handler to delegate to, so it replays goas
+	// itself when building each entry's payload (see (*CloudLoggingHandler).apiPayload).
+	goas []groupOrAttrs
+}
+
+// groupOrAttrs is either a WithGroup call (group set) or a WithAttrs call
+// (attrs set).
+type groupOrAttrs struct {
+	group string
+	attrs []slog.Attr
+}
+
+// topLevelWriter sits between the JSON handler and stderr. Cloud Logging's
+// special fields (trace, labels, operation, httpRequest, the Error
+// Reporting markers, ...) must be siblings of the record's own attributes
+// at the top level of the JSON object, but slog.JSONHandler nests whatever
+// is added to a Record inside any group opened with WithGroup. Handle sets
+// pending before calling the wrapped handler so Write can merge those
+// fields into the line the handler produces, bypassing the group nesting.
+type topLevelWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	pending map[string]any
+}
+
+func (w *topLevelWriter) Write(line []byte) (int, error) {
+	if len(w.pending) == 0 {
+		return w.out.Write(line)
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(line, &obj); err != nil {
+		return w.out.Write(line)
+	}
+	for k, v := range w.pending {
+		obj[k] = v
+	}
+	merged, err := json.Marshal(obj)
+	if err != nil {
+		return w.out.Write(line)
+	}
+	if _, err := w.out.Write(append(merged, '\n')); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+func NewCloudLoggingHandler(opts ...Option) *CloudLoggingHandler {
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	writer := &topLevelWriter{out: os.Stderr}
+	return &CloudLoggingHandler{
+		errorReporting: cfg.errorReporting,
+		writer:         writer,
+		handler: slog.NewJSONHandler(writer, &slog.HandlerOptions{
+			AddSource: true,
+			Level:     slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.MessageKey {
+					a.Key = "message"
+				} else if a.Key == slog.SourceKey {
+					a.Key = "logging.googleapis.com/sourceLocation"
+				} else if a.Key == slog.LevelKey {
+					a.Key = "severity"
+					level := a.Value.Any().(slog.Level)
+					a.Value = slog.StringValue(severityString(level))
 				}
-			}
-			return a
-		},
-	})}
+				return a
+			},
+		}),
+	}
+}
+
+// NewCloudLoggingAPIHandler returns a CloudLoggingHandler that writes
+// entries directly via the Cloud Logging API (cloud.google.com/go/logging)
+// instead of as JSON on stderr for the logging agent to pick up. Entries
+// are buffered and flushed asynchronously in batches (see BatchSize and
+// FlushInterval); records at CRITICAL severity or above are flushed
+// synchronously instead. Call the returned close function during shutdown
+// to drain the buffer and close the client.
+//
+// Prefer NewCloudLoggingHandler on Cloud Run, where the logging agent reads
+// stderr for you; use this constructor on GKE/GCE workloads where the agent
+// isn't available.
+func NewCloudLoggingAPIHandler(ctx context.Context, projectID, logID string, opts ...Option) (*CloudLoggingHandler, func() error, error) {
+	cfg := handlerConfig{batchSize: defaultBatchSize, flushInterval: defaultFlushInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	client, err := logging.NewClient(ctx, fmt.Sprintf("projects/%s", projectID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cloudrun-slog: creating logging client: %w", err)
+	}
+
+	logger := client.Logger(logID,
+		logging.EntryCountThreshold(cfg.batchSize),
+		logging.DelayThreshold(cfg.flushInterval),
+	)
+
+	h := &CloudLoggingHandler{
+		errorReporting: cfg.errorReporting,
+		apiLogger:      logger,
+	}
+	return h, client.Close, nil
 }
 
 func (h *CloudLoggingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.handler == nil {
+		// API-path handler: no underlying slog.Handler to delegate to.
+		return level >= slog.LevelDebug
+	}
 	return h.handler.Enabled(ctx, level)
 }
 
 func (h *CloudLoggingHandler) Handle(ctx context.Context, rec slog.Record) error {
-	trace := traceFromContext(ctx)
-	if trace != "" {
-		rec = rec.Clone()
-		// Add trace ID	to the record so it is correlated with the Cloud Run request log
+	if h.apiLogger != nil {
+		return h.handleAPI(ctx, rec)
+	}
+
+	fields := h.specialFields(ctx, rec)
+	if _, ok := fields["httpRequest"]; ok {
+		rec = withoutAttr(rec, "httpRequest")
+	}
+	// Always go through withPending, even with an empty fields map: it holds
+	// writer.mu for the call, which is what keeps a record with no special
+	// fields from being interleaved, at the Write step, with another
+	// goroutine's pending fields meant for a different line.
+	return h.writer.withPending(fields, func() error {
+		return h.handler.Handle(ctx, rec)
+	})
+}
+
+// specialFields collects the Cloud Logging special fields for rec: the
+// trace/operation/labels context, the Error Reporting markers, and the
+// httpRequest attribute LogHTTPRequest attaches to request-log records.
+// These must sit at the top level of the emitted JSON object for Cloud
+// Logging to recognize them, so Handle keeps them out of rec's own
+// attributes (where an active WithGroup would nest them) and has
+// topLevelWriter merge them back in after the wrapped handler runs.
+func (h *CloudLoggingHandler) specialFields(ctx context.Context, rec slog.Record) map[string]any {
+	fields := map[string]any{}
+
+	info := traceInfoFromContext(ctx)
+	if info.trace != "" {
+		// Add trace ID to the record so it is correlated with the Cloud Run request log
 		// See https://cloud.google.com/trace/docs/trace-log-integration
-		rec.Add("logging.googleapis.com/trace", slog.StringValue(trace))
+		fields["logging.googleapis.com/trace"] = info.trace
+		if info.spanID != "" {
+			fields["logging.googleapis.com/spanId"] = info.spanID
+			fields["logging.googleapis.com/trace_sampled"] = info.sampled
+		}
+	}
+	if labels := labelsFromContext(ctx); len(labels) > 0 {
+		fields["logging.googleapis.com/labels"] = labels
+	}
+	if op, hasOp := operationFromContext(ctx); hasOp {
+		fields["logging.googleapis.com/operation"] = map[string]any{
+			"id":       op.id,
+			"producer": op.producer,
+			"first":    op.first,
+			"last":     op.last,
+		}
+	}
+	if h.errorReporting != nil && rec.Level >= slog.LevelError {
+		fields["@type"] = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+		fields["serviceContext"] = map[string]string{
+			"service": h.errorReporting.service,
+			"version": h.errorReporting.version,
+		}
+		fields["stack_trace"] = stackTraceFor(rec)
+	}
+	if reqInfo, ok := httpRequestAttrFromRecord(rec); ok {
+		fields["httpRequest"] = reqInfo
+	}
+
+	return fields
+}
+
+// withPending merges fields into the next line written to w, then clears
+// the merge so later writes are unaffected. It holds w's lock for the
+// duration of write, which serializes with any other Handle call using the
+// same writer.
+func (w *topLevelWriter) withPending(fields map[string]any, write func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = fields
+	defer func() { w.pending = nil }()
+	return write()
+}
+
+// withoutAttr returns a copy of rec with the attribute named key removed.
+// It is used to pull the httpRequest attribute out of the record before
+// handing it to the wrapped handler, since it is re-added at the top level
+// by specialFields/topLevelWriter instead.
+func withoutAttr(rec slog.Record, key string) slog.Record {
+	out := slog.NewRecord(rec.Time, rec.Level, rec.Message, rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key != key {
+			out.AddAttrs(a)
+		}
+		return true
+	})
+	return out
+}
+
+// handleAPI implements Handle for handlers created by
+// NewCloudLoggingAPIHandler, populating a logging.Entry directly rather
+// than going through JSON.
+func (h *CloudLoggingHandler) handleAPI(ctx context.Context, rec slog.Record) error {
+	entry := logging.Entry{
+		Timestamp:   rec.Time,
+		Severity:    apiSeverity(rec.Level),
+		Payload:     h.apiPayload(rec),
+		HTTPRequest: apiHTTPRequest(rec),
+	}
+
+	info := traceInfoFromContext(ctx)
+	if info.trace != "" {
+		entry.Trace = info.trace
+		entry.SpanID = info.spanID
+		entry.TraceSampled = info.sampled
+	}
+	if labels := labelsFromContext(ctx); len(labels) > 0 {
+		entry.Labels = labels
+	}
+	if op, ok := operationFromContext(ctx); ok {
+		entry.Operation = &logpb.LogEntryOperation{
+			Id:       op.id,
+			Producer: op.producer,
+			First:    op.first,
+			Last:     op.last,
+		}
+	}
+	if rec.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{rec.PC}).Next()
+		entry.SourceLocation = &logpb.LogEntrySourceLocation{
+			File:     frame.File,
+			Line:     int64(frame.Line),
+			Function: frame.Function,
+		}
+	}
+
+	if h.errorReporting != nil && rec.Level >= slog.LevelError {
+		payload := entry.Payload.(map[string]any)
+		payload["@type"] = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+		payload["serviceContext"] = map[string]string{
+			"service": h.errorReporting.service,
+			"version": h.errorReporting.version,
+		}
+		payload["stack_trace"] = stackTraceFor(rec)
+	}
+
+	if rec.Level >= LevelCritical {
+		return h.apiLogger.LogSync(ctx, entry)
+	}
+	h.apiLogger.Log(entry)
+	return nil
+}
+
+// apiSeverity translates a slog.Level to the corresponding logging.Severity.
+func apiSeverity(level slog.Level) logging.Severity {
+	switch {
+	case level < slog.LevelInfo:
+		return logging.Debug
+	case level < LevelNotice:
+		return logging.Info
+	case level < slog.LevelWarn:
+		return logging.Notice
+	case level < slog.LevelError:
+		return logging.Warning
+	case level < LevelCritical:
+		return logging.Error
+	case level < LevelAlert:
+		return logging.Critical
+	case level < LevelEmergency:
+		return logging.Alert
+	default:
+		return logging.Emergency
 	}
-	return h.handler.Handle(ctx, rec)
+}
+
+// apiPayload builds the JSON payload for a logging.Entry from the handler's
+// accumulated WithAttrs/WithGroup calls and the record's own message and
+// attributes, leaving out the "httpRequest" attribute (which apiHTTPRequest
+// turns into the entry's dedicated HTTPRequest field instead).
+func (h *CloudLoggingHandler) apiPayload(rec slog.Record) map[string]any {
+	payload := map[string]any{"message": rec.Message}
+	cur := payload
+	for _, goa := range h.goas {
+		if goa.group != "" {
+			nested := map[string]any{}
+			cur[goa.group] = nested
+			cur = nested
+			continue
+		}
+		for _, a := range goa.attrs {
+			cur[a.Key] = a.Value.Any()
+		}
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key != "httpRequest" {
+			cur[a.Key] = a.Value.Any()
+		}
+		return true
+	})
+	return payload
+}
+
+// httpRequestAttrFromRecord extracts the httpRequestInfo LogHTTPRequest
+// attaches to a record, if any.
+func httpRequestAttrFromRecord(rec slog.Record) (httpRequestInfo, bool) {
+	var info httpRequestInfo
+	var found bool
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key == "httpRequest" {
+			info, found = a.Value.Any().(httpRequestInfo)
+			return false
+		}
+		return true
+	})
+	return info, found
+}
+
+// apiHTTPRequest extracts the httpRequestInfo LogHTTPRequest attaches to a
+// record, if any, and turns it into a logging.HTTPRequest.
+func apiHTTPRequest(rec slog.Record) *logging.HTTPRequest {
+	info, found := httpRequestAttrFromRecord(rec)
+	if !found {
+		return nil
+	}
+	return &logging.HTTPRequest{
+		Request:      info.request,
+		Status:       info.Status,
+		ResponseSize: info.responseSize,
+		Latency:      info.latency,
+		LocalIP:      info.ServerIp,
+		RemoteIP:     info.RemoteIp,
+	}
+}
+
+// stackTraceFor returns the stack trace to report for rec. If the record
+// carries an "err" attribute holding an error, that error's own formatting
+// is used (honoring github.com/pkg/errors-style fmt.Formatter errors, which
+// print their captured stack with "%+v"). Otherwise a stack trace of the
+// current goroutine is captured.
+func stackTraceFor(rec slog.Record) string {
+	var recErr error
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key == "err" {
+			if e, ok := a.Value.Any().(error); ok {
+				recErr = e
+				return false
+			}
+		}
+		return true
+	})
+	if recErr != nil {
+		if _, ok := recErr.(fmt.Formatter); ok {
+			return fmt.Sprintf("%+v", recErr)
+		}
+		return fmt.Sprintf("%s: %+v", rec.Message, recErr)
+	}
+	return goroutineStackTrace(rec.Message, rec.PC)
+}
+
+// goroutineStackTrace renders the current goroutine's call stack in the
+// panic-style format Error Reporting expects, starting at the frame whose
+// program counter is callerPC (the record's own call site) rather than at
+// this handler's internals, so Error Reporting groups errors by where they
+// were logged, not by Handle. If callerPC is 0 (no source info available),
+// the full captured stack is used as a fallback.
+func goroutineStackTrace(msg string, callerPC uintptr) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	b.WriteString("\n\ngoroutine 1 [running]:\n")
+
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(0, pcs)
+	pcs = pcs[:n]
+	if callerPC != 0 {
+		for i, pc := range pcs {
+			if pc == callerPC {
+				pcs = pcs[i:]
+				break
+			}
+		}
+	}
+
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s(...)\n\t%s:%d +0x0\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
 }
 
 func (h *CloudLoggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &CloudLoggingHandler{handler: h.handler.WithAttrs(attrs)}
+	if len(attrs) == 0 {
+		return h
+	}
+	clone := h.withGroupOrAttrs(groupOrAttrs{attrs: attrs})
+	if h.handler != nil {
+		clone.handler = h.handler.WithAttrs(attrs)
+	}
+	return clone
 }
 
 func (h *CloudLoggingHandler) WithGroup(name string) slog.Handler {
-	return &CloudLoggingHandler{handler: h.handler.WithGroup(name)}
+	if name == "" {
+		return h
+	}
+	clone := h.withGroupOrAttrs(groupOrAttrs{group: name})
+	if h.handler != nil {
+		clone.handler = h.handler.WithGroup(name)
+	}
+	return clone
+}
+
+// withGroupOrAttrs returns a copy of h with goa appended to its recorded
+// WithAttrs/WithGroup calls.
+func (h *CloudLoggingHandler) withGroupOrAttrs(goa groupOrAttrs) *CloudLoggingHandler {
+	clone := *h
+	clone.goas = make([]groupOrAttrs, len(h.goas)+1)
+	copy(clone.goas, h.goas)
+	clone.goas[len(clone.goas)-1] = goa
+	return &clone
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -126,7 +890,7 @@ func main() {
 		port = "8080"
 	}
 	log.Printf("listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, WithCloudTraceContext(mux)); err != nil {
+	if err := http.ListenAndServe(":"+port, WithCloudTraceContext(WithHTTPLogging(mux))); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestSeverityString(t *testing.T) {
+	cases := []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug, "DEBUG"},
+		{slog.LevelInfo, "INFO"},
+		{LevelNotice, "NOTICE"},
+		{slog.LevelWarn, "WARNING"},
+		{slog.LevelError, "ERROR"},
+		{LevelCritical, "CRITICAL"},
+		{LevelAlert, "ALERT"},
+		{LevelEmergency, "EMERGENCY"},
+		{LevelEmergency + 10, "EMERGENCY"},
+	}
+
+	for _, tc := range cases {
+		if got := severityString(tc.level); got != tc.want {
+			t.Errorf("severityString(%v) = %q, want %q", tc.level, got, tc.want)
+		}
+	}
+}
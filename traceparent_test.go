@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		name    string
+		header  string
+		traceID string
+		spanID  string
+		sampled bool
+		ok      bool
+	}{
+		{
+			name:    "valid sampled",
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			sampled: true,
+			ok:      true,
+		},
+		{
+			name:    "valid not sampled",
+			header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			sampled: false,
+			ok:      true,
+		},
+		{
+			name:   "reserved version ff",
+			header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			ok:     false,
+		},
+		{
+			name:   "all-zero trace-id",
+			header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			ok:     false,
+		},
+		{
+			name:   "all-zero span-id",
+			header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			ok:     false,
+		},
+		{
+			name:   "malformed",
+			header: "not-a-traceparent",
+			ok:     false,
+		},
+		{
+			name:   "empty",
+			header: "",
+			ok:     false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			traceID, spanID, sampled, ok := parseTraceParent(tc.header)
+			if ok != tc.ok {
+				t.Fatalf("ok = %v, want %v", ok, tc.ok)
+			}
+			if !tc.ok {
+				return
+			}
+			if traceID != tc.traceID || spanID != tc.spanID || sampled != tc.sampled {
+				t.Errorf("parseTraceParent(%q) = (%q, %q, %v), want (%q, %q, %v)",
+					tc.header, traceID, spanID, sampled, tc.traceID, tc.spanID, tc.sampled)
+			}
+		})
+	}
+}